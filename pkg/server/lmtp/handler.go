@@ -0,0 +1,496 @@
+package lmtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/log"
+	"github.com/jhillyerd/inbucket/pkg/policy"
+	"github.com/jhillyerd/inbucket/pkg/server/proto"
+)
+
+// Line length limits enforced by proto.ReadLimitedLine, per RFC 5321
+// §4.5.3.1 (LMTP inherits SMTP's command syntax).
+const (
+	maxCommandLineLength = 4000
+	maxDataLineLength    = 1000
+)
+
+// State tracks the current mode of our LMTP state machine
+type State int
+
+const (
+	// GREET State: Waiting for LHLO
+	GREET State = iota
+	// READY State: Got LHLO, waiting for MAIL
+	READY
+	// MAIL State: Got MAIL, accepting RCPTs
+	MAIL
+	// DATA State: Got DATA, waiting for "."
+	DATA
+	// QUIT State: Client requested end of session
+	QUIT
+)
+
+const timeStampFormat = "Mon, 02 Jan 2006 15:04:05 -0700 (MST)"
+
+func (s State) String() string {
+	switch s {
+	case GREET:
+		return "GREET"
+	case READY:
+		return "READY"
+	case MAIL:
+		return "MAIL"
+	case DATA:
+		return "DATA"
+	case QUIT:
+		return "QUIT"
+	}
+	return "Unknown"
+}
+
+// Unlike smtp, LMTP has no HELO/EHLO, SEND/SOML/SAML or TURN; RFC 2033
+// §4.2 directs servers to reject them as unrecognized.
+var commands = map[string]bool{
+	"LHLO": true,
+	"MAIL": true,
+	"RCPT": true,
+	"DATA": true,
+	"RSET": true,
+	"VRFY": true,
+	"EXPN": true,
+	"HELP": true,
+	"NOOP": true,
+	"QUIT": true,
+}
+
+// Session holds the state of an LMTP session
+type Session struct {
+	server       *Server
+	id           int
+	conn         net.Conn
+	remoteDomain string
+	remoteHost   string
+	sendError    error
+	state        State
+	reader       *bufio.Reader
+	from         string
+	recipients   []*policy.Recipient
+	errBudget    proto.ErrorBudget
+}
+
+// NewSession creates a new Session for the given connection
+func NewSession(server *Server, id int, conn net.Conn) *Session {
+	reader := bufio.NewReader(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &Session{
+		server:     server,
+		id:         id,
+		conn:       conn,
+		state:      GREET,
+		reader:     reader,
+		remoteHost: host,
+		recipients: make([]*policy.Recipient, 0),
+		errBudget:  proto.ErrorBudget{Max: server.MaxErrors},
+	}
+}
+
+func (ss *Session) String() string {
+	return fmt.Sprintf("Session{id: %v, state: %v}", ss.id, ss.state)
+}
+
+/* Session flow:
+ *  1. Send initial greeting
+ *  2. Receive cmd
+ *  3. If good cmd, respond, optionally change state
+ *  4. If bad cmd, respond error
+ *  5. Goto 2
+ */
+func (s *Server) startSession(id int, conn net.Conn) {
+	log.Infof("LMTP Connection from %v, starting session <%v>", conn.RemoteAddr(), id)
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Errorf("Error closing connection for <%v>: %v", id, err)
+		}
+		s.waitgroup.Done()
+	}()
+
+	ss := NewSession(s, id, conn)
+	ss.greet()
+
+	// This is our command reading loop
+	for ss.state != QUIT && ss.sendError == nil {
+		if ss.state == DATA {
+			// Special case, does not use SMTP command format
+			ss.dataHandler()
+			continue
+		}
+		line, err := ss.readLine()
+		if err == nil {
+			if cmd, arg, ok := ss.parseCmd(line); ok {
+				if cmd == "" {
+					ss.send("500 Speak up")
+					continue
+				}
+				if !commands[cmd] {
+					ss.send(fmt.Sprintf("500 Syntax error, %v command unrecognized", cmd))
+					ss.logWarn("Unrecognized command: %v", cmd)
+					continue
+				}
+
+				// Commands we handle in any state
+				switch cmd {
+				case "VRFY", "EXPN", "HELP":
+					ss.send(fmt.Sprintf("502 %v command not implemented", cmd))
+					continue
+				case "NOOP":
+					ss.send("250 I have sucessfully done nothing")
+					continue
+				case "RSET":
+					ss.logTrace("Resetting session state on RSET request")
+					ss.reset()
+					ss.send("250 Session reset")
+					continue
+				case "QUIT":
+					ss.send("221 Goodnight and good luck")
+					ss.enterState(QUIT)
+					continue
+				}
+
+				// Send command to handler for current state
+				switch ss.state {
+				case GREET:
+					ss.greetHandler(cmd, arg)
+					continue
+				case READY:
+					ss.readyHandler(cmd, arg)
+					continue
+				case MAIL:
+					ss.mailHandler(cmd, arg)
+					continue
+				}
+				ss.logError("Session entered unexpected state %v", ss.state)
+				break
+			} else {
+				ss.send("500 Syntax error, command garbled")
+			}
+		} else {
+			if err == io.EOF {
+				switch ss.state {
+				case GREET, READY:
+					ss.logInfo("Client closed connection (state %v)", ss.state)
+				default:
+					ss.logWarn("Got EOF while in state %v", ss.state)
+				}
+				break
+			}
+			if err == proto.ErrLineTooLong {
+				ss.send("500 Line too long")
+				ss.logWarn("Rejected command line exceeding %v bytes", maxCommandLineLength)
+				continue
+			}
+			ss.logWarn("Connection error: %v", err)
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					ss.send("221 Idle timeout, bye bye")
+					break
+				}
+			}
+			ss.send("221 Connection error, sorry")
+			break
+		}
+	}
+	if ss.sendError != nil {
+		ss.logWarn("Network send error: %v", ss.sendError)
+	}
+	ss.logInfo("Closing connection")
+}
+
+// GREET state -> waiting for LHLO
+func (ss *Session) greetHandler(cmd string, arg string) {
+	if cmd != "LHLO" {
+		// HELO/EHLO never get here: they are absent from commands, so the
+		// command loop already rejects them as unrecognized. This refuses
+		// any other command sent before LHLO.
+		ss.send("500 Command unrecognized, use LHLO")
+		ss.logWarn("Rejected %v, LMTP requires LHLO", cmd)
+		return
+	}
+	domain, err := parseHelloArgument(arg)
+	if err != nil {
+		ss.send("501 Domain/address argument required for LHLO")
+		return
+	}
+	ss.remoteDomain = domain
+	ss.send("250-Great, let's get this show on the road")
+	ss.send("250-8BITMIME")
+	ss.send(fmt.Sprintf("250 SIZE %v", ss.server.maxMessageBytes))
+	ss.enterState(READY)
+}
+
+func parseHelloArgument(arg string) (string, error) {
+	domain := arg
+	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
+		domain = arg[:idx]
+	}
+	if domain == "" {
+		return "", fmt.Errorf("Invalid domain")
+	}
+	return domain, nil
+}
+
+// READY state -> waiting for MAIL
+func (ss *Session) readyHandler(cmd string, arg string) {
+	if cmd != "MAIL" {
+		ss.ooSeq(cmd)
+		return
+	}
+	re := regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])+|\"[^\"]+\"@[^>]+)>( [\\w= ]+)?$")
+	m := re.FindStringSubmatch(arg)
+	if m == nil {
+		ss.send("501 Was expecting MAIL arg syntax of FROM:<address>")
+		ss.logWarn("Bad MAIL argument: %q", arg)
+		return
+	}
+	from := m[1]
+	if _, _, err := policy.ParseEmailAddress(from); err != nil {
+		ss.send("501 Bad sender address syntax")
+		ss.logWarn("Bad address as MAIL arg: %q, %s", from, err)
+		return
+	}
+	ss.from = from
+	ss.logInfo("Mail from: %v", from)
+	ss.send(fmt.Sprintf("250 Roger, accepting mail from <%v>", from))
+	ss.enterState(MAIL)
+}
+
+// MAIL state -> waiting for RCPTs followed by DATA
+func (ss *Session) mailHandler(cmd string, arg string) {
+	switch cmd {
+	case "RCPT":
+		if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
+			ss.send("501 Was expecting RCPT arg syntax of TO:<address>")
+			ss.logWarn("Bad RCPT argument: %q", arg)
+			return
+		}
+		addr := strings.Trim(arg[3:], "<> ")
+		recip, err := ss.server.apolicy.NewRecipient(addr)
+		if err != nil {
+			ss.send("501 Bad recipient address syntax")
+			ss.logWarn("Bad address as RCPT arg: %q, %s", addr, err)
+			return
+		}
+		if len(ss.recipients) >= ss.server.maxRecips {
+			ss.logWarn("Maximum limit of %v recipients reached", ss.server.maxRecips)
+			ss.send(fmt.Sprintf("552 Maximum limit of %v recipients reached", ss.server.maxRecips))
+			return
+		}
+		ss.recipients = append(ss.recipients, recip)
+		ss.logInfo("Recipient: %v", addr)
+		ss.send(fmt.Sprintf("250 I'll make sure <%v> gets this", addr))
+		return
+	case "DATA":
+		if arg != "" {
+			ss.send("501 DATA command should not have any arguments")
+			ss.logWarn("Got unexpected args on DATA: %q", arg)
+			return
+		}
+		if len(ss.recipients) > 0 {
+			ss.enterState(DATA)
+			return
+		}
+		ss.ooSeq(cmd)
+		return
+	}
+	ss.ooSeq(cmd)
+}
+
+// DATA: once the dot-terminator arrives, LMTP delivers to each recipient
+// independently and reports one status line per RCPT (RFC 2033 §4.2),
+// instead of a single 250 covering the whole transaction.
+func (ss *Session) dataHandler() {
+	ss.send("354 Start mail input; end with <CRLF>.<CRLF>")
+	msgBuf := &bytes.Buffer{}
+	for {
+		lineBuf, err := ss.readByteLine()
+		if err != nil {
+			if err == proto.ErrLineTooLong {
+				ss.send("500 Line too long")
+				ss.logWarn("DATA line exceeded %v bytes, aborting message", maxDataLineLength)
+				ss.reset()
+				return
+			}
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					ss.send("221 Idle timeout, bye bye")
+				}
+			}
+			ss.logWarn("Error: %v while reading", err)
+			ss.enterState(QUIT)
+			return
+		}
+		if bytes.Equal(lineBuf, []byte(".\r\n")) || bytes.Equal(lineBuf, []byte(".\n")) {
+			ss.deliverPerRecipient(msgBuf.Bytes())
+			ss.logInfo("Message size %v bytes", msgBuf.Len())
+			ss.reset()
+			return
+		}
+		// RFC: remove leading periods from DATA.
+		if len(lineBuf) > 0 && lineBuf[0] == '.' {
+			lineBuf = lineBuf[1:]
+		}
+		msgBuf.Write(lineBuf)
+		if msgBuf.Len() > ss.server.maxMessageBytes {
+			ss.send("552 Maximum message size exceeded")
+			ss.logWarn("Max message size exceeded while in DATA")
+			ss.reset()
+			return
+		}
+	}
+}
+
+// deliverPerRecipient stores data for each recipient independently,
+// sending its own status line so a single bad mailbox doesn't fail the
+// whole transaction.
+func (ss *Session) deliverPerRecipient(data []byte) {
+	tstamp := time.Now().Format(timeStampFormat)
+	for _, recip := range ss.recipients {
+		if !recip.ShouldStore() {
+			ss.send(fmt.Sprintf("250 %v Ok", recip.Address.Address))
+			continue
+		}
+		prefix := fmt.Sprintf("Received: from %s ([%s]) by %s (LMTP)\r\n  for <%s>; %s\r\n",
+			ss.remoteDomain, ss.remoteHost, ss.server.domain, recip.Address.Address, tstamp)
+		if _, err := ss.server.manager.Deliver(recip, ss.from, ss.recipients, prefix, data); err != nil {
+			ss.logError("delivery for %v: %v", recip.LocalPart, err)
+			ss.send(fmt.Sprintf("550 %v failed", recip.Address.Address))
+			continue
+		}
+		ss.send(fmt.Sprintf("250 %v Ok", recip.Address.Address))
+	}
+}
+
+func (ss *Session) enterState(state State) {
+	ss.state = state
+	ss.logTrace("Entering state %v", state)
+}
+
+func (ss *Session) greet() {
+	ss.send(fmt.Sprintf("220 %v Inbucket LMTP ready", ss.server.domain))
+}
+
+// Calculate the next read or write deadline based on maxIdle
+func (ss *Session) nextDeadline() time.Time {
+	return time.Now().Add(ss.server.maxIdle)
+}
+
+// Send requested message, store errors in Session.sendError
+func (ss *Session) send(msg string) {
+	if err := ss.conn.SetWriteDeadline(ss.nextDeadline()); err != nil {
+		ss.sendError = err
+		return
+	}
+	if _, err := fmt.Fprint(ss.conn, msg+"\r\n"); err != nil {
+		ss.sendError = err
+		ss.logWarn("Failed to send: %q", msg)
+		return
+	}
+	ss.logTrace(">> %v >>", msg)
+	if len(msg) >= 3 && msg[0] == '5' {
+		ss.trackError()
+	}
+}
+
+// trackError counts a 5xx response against Server.MaxErrors, closing the
+// connection once the budget is exceeded.  This keeps a misbehaving or
+// malicious client from pegging a goroutine by issuing endless garbage.
+func (ss *Session) trackError() {
+	if ss.errBudget.Track() {
+		ss.logWarn("Too many errors, closing connection")
+		ss.send("421 Too many errors")
+		ss.enterState(QUIT)
+	}
+}
+
+// readByteLine reads a line of input, returns byte slice.
+func (ss *Session) readByteLine() ([]byte, error) {
+	if err := ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
+		return nil, err
+	}
+	return proto.ReadLimitedLine(ss.reader, maxDataLineLength)
+}
+
+// Reads a line of input
+func (ss *Session) readLine() (line string, err error) {
+	if err = ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
+		return "", err
+	}
+	buf, err := proto.ReadLimitedLine(ss.reader, maxCommandLineLength)
+	if err != nil {
+		return "", err
+	}
+	line = string(buf)
+	ss.logTrace("<< %v <<", strings.TrimRight(line, "\r\n"))
+	return line, nil
+}
+
+func (ss *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	l := len(line)
+	switch {
+	case l == 0:
+		return "", "", true
+	case l < 4:
+		ss.logWarn("Command too short: %q", line)
+		return "", "", false
+	case l == 4:
+		return strings.ToUpper(line), "", true
+	case l == 5:
+		ss.logWarn("Mangled command: %q", line)
+		return "", "", false
+	}
+	if line[4] != ' ' {
+		ss.logWarn("Mangled command: %q", line)
+		return "", "", false
+	}
+	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " "), true
+}
+
+func (ss *Session) reset() {
+	// trackError may have entered QUIT while this transaction was being
+	// rejected; don't reopen the session in that case.
+	if ss.state != QUIT {
+		ss.enterState(READY)
+	}
+	ss.from = ""
+	ss.recipients = nil
+}
+
+func (ss *Session) ooSeq(cmd string) {
+	ss.send(fmt.Sprintf("503 Command %v is out of sequence", cmd))
+	ss.logWarn("Wasn't expecting %v here", cmd)
+}
+
+// Session specific logging methods
+func (ss *Session) logTrace(msg string, args ...interface{}) {
+	log.Tracef("LMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+}
+
+func (ss *Session) logInfo(msg string, args ...interface{}) {
+	log.Infof("LMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+}
+
+func (ss *Session) logWarn(msg string, args ...interface{}) {
+	log.Warnf("LMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+}
+
+func (ss *Session) logError(msg string, args ...interface{}) {
+	log.Errorf("LMTP[%v]<%v> %v", ss.remoteHost, ss.id, fmt.Sprintf(msg, args...))
+}
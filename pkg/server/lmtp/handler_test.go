@@ -0,0 +1,126 @@
+package lmtp
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/policy"
+)
+
+// recordingManager is a test Manager that records each delivery, so tests
+// can assert per-recipient delivery without a real storage backend.
+type recordingManager struct {
+	mu         sync.Mutex
+	deliveries []string
+}
+
+func (m *recordingManager) Deliver(recip *policy.Recipient, from string, recipients []*policy.Recipient,
+	prefix string, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = append(m.deliveries, recip.Address.Address)
+	return "id", nil
+}
+
+// readLMTPReply reads a (possibly multi-line) LMTP reply and returns its
+// final line.
+func readLMTPReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var last string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading LMTP reply: %v", err)
+		}
+		last = line
+		if len(line) > 3 && line[3] == ' ' {
+			return last
+		}
+	}
+}
+
+// TestLHLOMailRcptDataDeliversPerRecipient confirms a full LHLO/MAIL/RCPT/
+// DATA transaction delivers to each recipient independently, per RFC 2033
+// §4.2's one-status-line-per-RCPT contract.
+func TestLHLOMailRcptDataDeliversPerRecipient(t *testing.T) {
+	manager := &recordingManager{}
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, manager, &policy.Addressing{})
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readLMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("LHLO client.example.com")
+	readLMTPReply(t, client)
+
+	send("MAIL FROM:<a@example.com>")
+	if reply := readLMTPReply(t, client); reply[:3] != "250" {
+		t.Fatalf("MAIL FROM failed: %q", reply)
+	}
+
+	send("RCPT TO:<b@example.com>")
+	if reply := readLMTPReply(t, client); reply[:3] != "250" {
+		t.Fatalf("RCPT TO failed: %q", reply)
+	}
+
+	send("DATA")
+	if reply := readLMTPReply(t, client); reply[:3] != "354" {
+		t.Fatalf("DATA failed: %q", reply)
+	}
+	send("Subject: test\r\n\r\nbody")
+	send(".")
+	if reply := readLMTPReply(t, client); reply[:3] != "250" {
+		t.Fatalf("expected per-recipient 250, got %q", reply)
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if len(manager.deliveries) != 1 || manager.deliveries[0] != "b@example.com" {
+		t.Errorf("deliveries = %v, want [b@example.com]", manager.deliveries)
+	}
+}
+
+// TestLMTPLineTooLongDoesNotDesyncConnection confirms a command line
+// exceeding maxCommandLineLength is rejected and fully drained so the
+// connection stays usable for subsequent commands.
+func TestLMTPLineTooLongDoesNotDesyncConnection(t *testing.T) {
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, &recordingManager{}, &policy.Addressing{})
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readLMTPReply(t, client) // greeting
+
+	go func() {
+		overlong := make([]byte, maxCommandLineLength+500)
+		for i := range overlong {
+			overlong[i] = 'A'
+		}
+		clientConn.Write(overlong)
+		clientConn.Write([]byte("\r\n"))
+		clientConn.Write([]byte("NOOP\r\n"))
+	}()
+
+	if reply := readLMTPReply(t, client); reply[:3] != "500" {
+		t.Fatalf("expected 500 Line too long, got %q", reply)
+	}
+	if reply := readLMTPReply(t, client); reply[:3] != "250" {
+		t.Errorf("connection desynced after long line: NOOP got %q, want 250", reply)
+	}
+}
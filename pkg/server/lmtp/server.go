@@ -0,0 +1,92 @@
+// Package lmtp implements an RFC 2033 LMTP listener, a close sibling of
+// pkg/server/smtp tailored for use as a local mail delivery agent behind an
+// MTA such as Postfix or Dovecot.
+package lmtp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/log"
+	"github.com/jhillyerd/inbucket/pkg/policy"
+)
+
+// defaultMaxErrors is the default value of Server.MaxErrors.
+const defaultMaxErrors = 3
+
+// Manager delivers an accepted message to the configured storage backend.
+type Manager interface {
+	Deliver(recip *policy.Recipient, from string, recipients []*policy.Recipient, prefix string,
+		data []byte) (string, error)
+}
+
+// Server holds the configuration and state of an LMTP server instance.
+type Server struct {
+	domain          string
+	maxRecips       int
+	maxIdle         time.Duration
+	maxMessageBytes int
+	manager         Manager
+	apolicy         *policy.Addressing
+
+	listener  net.Listener
+	waitgroup *sync.WaitGroup
+
+	// MaxErrors is the number of 5xx responses tolerated on a connection
+	// before it is dropped with "421 Too many errors".  Zero disables the
+	// limit. Defaults to defaultMaxErrors.
+	MaxErrors int
+}
+
+// NewServer creates a new, unstarted Server.
+func NewServer(domain string, maxRecips int, maxIdle time.Duration, maxMessageBytes int,
+	manager Manager, apolicy *policy.Addressing) *Server {
+	return &Server{
+		domain:          domain,
+		maxRecips:       maxRecips,
+		maxIdle:         maxIdle,
+		maxMessageBytes: maxMessageBytes,
+		manager:         manager,
+		apolicy:         apolicy,
+		waitgroup:       new(sync.WaitGroup),
+		MaxErrors:       defaultMaxErrors,
+	}
+}
+
+// Start accepts connections on addr until Stop is called.
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", addr, err)
+	}
+	s.listener = listener
+	log.Infof("LMTP listening on TCP %v", addr)
+
+	var id int
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("Temporary error accepting LMTP connection: %v", err)
+				continue
+			}
+			// Listener closed, shutting down.
+			return nil
+		}
+		s.waitgroup.Add(1)
+		id++
+		go s.startSession(id, conn)
+	}
+}
+
+// Stop closes the listening socket, allowing in-flight sessions to finish.
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.waitgroup.Wait()
+	return err
+}
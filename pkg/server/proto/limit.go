@@ -0,0 +1,53 @@
+// Package proto contains line-reading and abuse-budget helpers shared by
+// Inbucket's SMTP and LMTP listeners.
+package proto
+
+import (
+	"bufio"
+	"errors"
+)
+
+// ErrLineTooLong is returned by ReadLimitedLine when a line exceeds its
+// configured limit without ever finding a terminating newline.
+var ErrLineTooLong = errors.New("line too long")
+
+// ReadLimitedLine reads a single line, up to maxLen bytes, from r.  If no
+// newline is found within that limit, the remainder of the line is
+// drained (so the connection doesn't desync) and ErrLineTooLong is
+// returned instead of buffering an unbounded amount of input.
+func ReadLimitedLine(r *bufio.Reader, maxLen int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLen {
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			return nil, ErrLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+// ErrorBudget counts 5xx responses against a configured maximum, closing
+// the connection once exceeded.  This keeps a misbehaving or malicious
+// client from pegging a goroutine by issuing endless garbage.  A zero Max
+// disables the limit.
+type ErrorBudget struct {
+	Max   int
+	count int
+}
+
+// Track records one more error and reports whether the budget has now
+// been exceeded.
+func (b *ErrorBudget) Track() bool {
+	if b.Max <= 0 {
+		return false
+	}
+	b.count++
+	return b.count > b.Max
+}
@@ -0,0 +1,57 @@
+package proto
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadLimitedLineWithinLimit(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("hello\r\nworld\r\n"))
+	line, err := ReadLimitedLine(r, 32)
+	if err != nil {
+		t.Fatalf("ReadLimitedLine: %v", err)
+	}
+	if string(line) != "hello\r\n" {
+		t.Errorf("line = %q, want %q", line, "hello\r\n")
+	}
+}
+
+func TestReadLimitedLineTooLong(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(strings.Repeat("a", 100) + "\r\nNOOP\r\n"))
+	_, err := ReadLimitedLine(r, 16)
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("err = %v, want ErrLineTooLong", err)
+	}
+	// The oversized line's remainder must have been drained so the next
+	// read lands on the following line rather than leftover garbage.
+	line, err := ReadLimitedLine(r, 16)
+	if err != nil {
+		t.Fatalf("ReadLimitedLine after overflow: %v", err)
+	}
+	if string(line) != "NOOP\r\n" {
+		t.Errorf("line after overflow = %q, want %q", line, "NOOP\r\n")
+	}
+}
+
+func TestErrorBudgetDisabledWhenZero(t *testing.T) {
+	b := &ErrorBudget{}
+	for i := 0; i < 100; i++ {
+		if b.Track() {
+			t.Fatal("Track() exceeded with Max = 0, want never exceeded")
+		}
+	}
+}
+
+func TestErrorBudgetExceeded(t *testing.T) {
+	b := &ErrorBudget{Max: 3}
+	for i := 0; i < 3; i++ {
+		if b.Track() {
+			t.Fatalf("Track() exceeded early at count %d, want not yet", i+1)
+		}
+	}
+	if !b.Track() {
+		t.Error("Track() = false on 4th error, want true (budget exceeded)")
+	}
+}
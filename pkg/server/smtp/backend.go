@@ -0,0 +1,183 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/policy"
+)
+
+// Backend is implemented by applications embedding the SMTP server to plug
+// custom logic into a transaction: reject senders/recipients, mutate the
+// received message, or short-circuit delivery entirely -- enabling
+// programmable spam-simulation, greylisting tests, or bounce-injection
+// scenarios. It mirrors the shape of github.com/emersion/go-smtp's
+// Backend/Session split. Server falls back to a storage-backed
+// defaultBackend when none is configured.
+type Backend interface {
+	// NewSession is called when a connection is accepted, before any
+	// commands are processed, and again after a successful STARTTLS
+	// handshake to replace the pre-TLS session.
+	NewSession(remoteHost string) (BackendSession, error)
+}
+
+// MailOptions carries the ESMTP parameters accepted alongside MAIL FROM.
+type MailOptions struct {
+	// Size is the value of the SIZE parameter, if the client sent one.
+	Size int
+	// AuthUser is the identity established via AUTH (see Server.Authenticator),
+	// if the session is authenticated.
+	AuthUser string
+}
+
+// BackendSession receives the validated events of a single SMTP
+// transaction: one per connection, plus a fresh one after STARTTLS.
+// Returned errors are sent to the client
+// as-is if they already look like an SMTP reply line ("550 ..."),
+// otherwise they're wrapped with a sensible default code -- see
+// formatBackendErr.
+type BackendSession interface {
+	// Greet is called once the client identifies itself via HELO/EHLO.
+	Greet(domain string) error
+	// Mail is called on MAIL FROM, before any RCPT is accepted.
+	Mail(from string, opts MailOptions) error
+	// Rcpt is called once per RCPT TO.
+	Rcpt(to string) error
+	// Data is called with the full message body once the client finishes
+	// sending it, whether via the dot-terminated DATA command or the
+	// final BDAT chunk. Implementations that mutate or inspect the
+	// message should read r to completion.
+	Data(r io.Reader) error
+	// Reset is called on RSET, and after each completed or aborted
+	// transaction, before the next one begins.
+	Reset()
+	// Logout is called once per session: as the connection is closing, or
+	// when STARTTLS replaces the pre-TLS session.
+	Logout() error
+}
+
+// formatBackendErr turns a BackendSession error into an SMTP reply line.
+// An error that already looks like one ("550 Mailbox unavailable") is
+// used verbatim; otherwise it's wrapped with defaultCode.
+func formatBackendErr(err error, defaultCode string) string {
+	msg := err.Error()
+	if len(msg) >= 4 && isSMTPCode(msg[:3]) && msg[3] == ' ' {
+		return msg
+	}
+	return defaultCode + " " + msg
+}
+
+func isSMTPCode(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// noopBackendSession discards everything; it stands in for a session that
+// has already been logged out (e.g. the pre-TLS session during STARTTLS)
+// so a later unconditional Logout() call doesn't reach the real backend a
+// second time.
+type noopBackendSession struct{}
+
+func (noopBackendSession) Greet(domain string) error                { return nil }
+func (noopBackendSession) Mail(from string, opts MailOptions) error { return nil }
+func (noopBackendSession) Rcpt(to string) error                     { return nil }
+func (noopBackendSession) Data(r io.Reader) error                   { return nil }
+func (noopBackendSession) Reset()                                   {}
+func (noopBackendSession) Logout() error                            { return nil }
+
+// defaultBackend reproduces Inbucket's original storage-backed behavior,
+// used whenever Server.Backend isn't set.
+type defaultBackend struct {
+	domain  string
+	manager Manager
+	apolicy *policy.Addressing
+}
+
+// NewSession implements Backend.
+func (b *defaultBackend) NewSession(remoteHost string) (BackendSession, error) {
+	return &defaultSession{
+		domain:     b.domain,
+		manager:    b.manager,
+		apolicy:    b.apolicy,
+		remoteHost: remoteHost,
+	}, nil
+}
+
+// defaultSession tracks just enough transaction state to reproduce the
+// storage delivery Inbucket has always done, independent of the protocol
+// engine's own bookkeeping in Session.
+type defaultSession struct {
+	domain       string
+	manager      Manager
+	apolicy      *policy.Addressing
+	remoteHost   string
+	remoteDomain string
+	from         string
+	authUser     string
+	recipients   []*policy.Recipient
+}
+
+// Greet implements BackendSession.
+func (s *defaultSession) Greet(domain string) error {
+	s.remoteDomain = domain
+	return nil
+}
+
+// Mail implements BackendSession.
+func (s *defaultSession) Mail(from string, opts MailOptions) error {
+	s.from = from
+	s.authUser = opts.AuthUser
+	return nil
+}
+
+// Rcpt implements BackendSession.
+func (s *defaultSession) Rcpt(to string) error {
+	recip, err := s.apolicy.NewRecipient(to)
+	if err != nil {
+		return err
+	}
+	s.recipients = append(s.recipients, recip)
+	return nil
+}
+
+// Data implements BackendSession, storing the message for every recipient
+// that wants a copy kept.
+func (s *defaultSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tstamp := time.Now().Format(timeStampFormat)
+	authNote := ""
+	if s.authUser != "" {
+		authNote = fmt.Sprintf(" (authenticated as %s)", s.authUser)
+	}
+	for _, recip := range s.recipients {
+		if recip.ShouldStore() {
+			prefix := fmt.Sprintf("Received: from %s ([%s])%s by %s\r\n  for <%s>; %s\r\n",
+				s.remoteDomain, s.remoteHost, authNote, s.domain, recip.Address.Address, tstamp)
+			if _, err := s.manager.Deliver(recip, s.from, s.recipients, prefix, data); err != nil {
+				return fmt.Errorf("451 failed to store message for %v: %v", recip.LocalPart, err)
+			}
+		}
+		expReceivedTotal.Add(1)
+	}
+	return nil
+}
+
+// Reset implements BackendSession.
+func (s *defaultSession) Reset() {
+	s.from = ""
+	s.authUser = ""
+	s.recipients = nil
+}
+
+// Logout implements BackendSession.
+func (s *defaultSession) Logout() error {
+	return nil
+}
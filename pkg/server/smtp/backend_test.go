@@ -0,0 +1,184 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/policy"
+)
+
+func TestFormatBackendErrPassesThroughSMTPReply(t *testing.T) {
+	err := errors.New("550 Mailbox unavailable")
+	if got := formatBackendErr(err, "451"); got != "550 Mailbox unavailable" {
+		t.Errorf("formatBackendErr = %q, want the error passed through verbatim", got)
+	}
+}
+
+func TestFormatBackendErrWrapsPlainError(t *testing.T) {
+	err := errors.New("disk full")
+	if got := formatBackendErr(err, "451"); got != "451 disk full" {
+		t.Errorf("formatBackendErr = %q, want %q", got, "451 disk full")
+	}
+}
+
+// deliverRecordingManager records deliveries made through defaultSession,
+// so tests can assert the storage-backed default Backend's behavior
+// without a real storage.Manager.
+type deliverRecordingManager struct {
+	from       string
+	recipients []*policy.Recipient
+	prefix     string
+	data       []byte
+}
+
+func (m *deliverRecordingManager) Deliver(recip *policy.Recipient, from string,
+	recipients []*policy.Recipient, prefix string, data []byte) (string, error) {
+	m.from = from
+	m.prefix = prefix
+	m.recipients = recipients
+	m.data = data
+	return "id", nil
+}
+
+// TestDefaultBackendDeliversToRecipients confirms the fallback
+// storage-backed Backend used when Server.Backend is unset drives a
+// transaction through to Manager.Deliver with the authenticated identity
+// threaded through MailOptions.
+func TestDefaultBackendDeliversToRecipients(t *testing.T) {
+	manager := &deliverRecordingManager{}
+	backend := &defaultBackend{
+		domain:  "mail.example.com",
+		manager: manager,
+		apolicy: &policy.Addressing{},
+	}
+
+	session, err := backend.NewSession("client.example.com")
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.Greet("client.example.com"); err != nil {
+		t.Fatalf("Greet: %v", err)
+	}
+	if err := session.Mail("alice@example.com", MailOptions{AuthUser: "alice"}); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := session.Rcpt("bob@example.com"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	if err := session.Data(strings.NewReader("hello")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+
+	if manager.from != "alice@example.com" {
+		t.Errorf("manager.from = %q, want %q", manager.from, "alice@example.com")
+	}
+	if len(manager.recipients) != 1 || manager.recipients[0].Address.Address != "bob@example.com" {
+		t.Errorf("manager.recipients = %v, want [bob@example.com]", manager.recipients)
+	}
+	if string(manager.data) != "hello" {
+		t.Errorf("manager.data = %q, want %q", manager.data, "hello")
+	}
+	if !strings.Contains(manager.prefix, "(authenticated as alice)") {
+		t.Errorf("manager.prefix = %q, want it to name the authenticated user alice", manager.prefix)
+	}
+
+	session.Reset()
+	if err := session.Logout(); err != nil {
+		t.Errorf("Logout: %v", err)
+	}
+}
+
+// logoutCountingBackend records how many times Logout was called across
+// all sessions it has handed out, and rejects every session after the
+// first so starttlsHandler's post-handshake NewSession call fails.
+type logoutCountingBackend struct {
+	mu          sync.Mutex
+	sessions    int
+	logoutCalls int
+}
+
+func (b *logoutCountingBackend) NewSession(remoteHost string) (BackendSession, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions++
+	if b.sessions > 1 {
+		return nil, errors.New("no more sessions for you")
+	}
+	return &logoutCountingSession{backend: b}, nil
+}
+
+type logoutCountingSession struct {
+	backend *logoutCountingBackend
+}
+
+func (s *logoutCountingSession) Greet(domain string) error                { return nil }
+func (s *logoutCountingSession) Mail(from string, opts MailOptions) error { return nil }
+func (s *logoutCountingSession) Rcpt(to string) error                     { return nil }
+func (s *logoutCountingSession) Data(r io.Reader) error                   { return nil }
+func (s *logoutCountingSession) Reset()                                   {}
+
+func (s *logoutCountingSession) Logout() error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.backend.logoutCalls++
+	return nil
+}
+
+// TestStarttlsDoesNotDoubleLogoutOnNewSessionFailure confirms that when
+// the post-handshake Backend.NewSession call fails, starttlsHandler
+// doesn't leave ss.backend pointing at the already-logged-out pre-TLS
+// session -- otherwise the unconditional Logout() at the end of
+// startSession would invoke it a second time.
+func TestStarttlsDoesNotDoubleLogoutOnNewSessionFailure(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	backend := &logoutCountingBackend{}
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, nil, nil)
+	server.Backend = backend
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readSMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("EHLO client.example.com")
+	readSMTPReply(t, client)
+
+	send("STARTTLS")
+	if reply := readSMTPReply(t, client); reply[:3] != "220" {
+		t.Fatalf("STARTTLS failed: %q", reply)
+	}
+	tlsClient := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake: %v", err)
+	}
+	defer tlsClient.Close()
+	clientConn.Close()
+	tlsClient.Close()
+
+	// Give startSession time to notice the closed connection and run its
+	// end-of-connection cleanup.
+	time.Sleep(100 * time.Millisecond)
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.logoutCalls != 1 {
+		t.Errorf("Logout called %d times, want exactly 1", backend.logoutCalls)
+	}
+}
@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestBdatOversizedChunkDrainsConnection confirms bdatHandler drains the
+// chunk bytes already incoming on the wire before replying with 552 and
+// resetting, so the connection stays in sync and the next command line is
+// parsed correctly instead of being mistaken for leftover chunk data.
+func TestBdatOversizedChunkDrainsConnection(t *testing.T) {
+	server := NewServer("mail.example.com", 5, 5*time.Second, 100, nil, nil)
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readSMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("EHLO client.example.com")
+	readSMTPReply(t, client)
+	send("MAIL FROM:<a@example.com>")
+	readSMTPReply(t, client)
+	send("RCPT TO:<b@example.com>")
+	readSMTPReply(t, client)
+
+	chunkSize := 1000
+	go func() {
+		// net.Pipe is unbuffered, so a server that fails to drain the
+		// chunk would leave this write blocked rather than erroring out.
+		clientConn.Write([]byte("BDAT 1000 LAST\r\n"))
+		clientConn.Write(bytes.Repeat([]byte("A"), chunkSize))
+	}()
+
+	reply := readSMTPReply(t, client)
+	if reply[:3] != "552" {
+		t.Fatalf("expected 552 Maximum message size exceeded, got %q", reply)
+	}
+
+	send("NOOP")
+	if reply := readSMTPReply(t, client); reply[:3] != "250" {
+		t.Errorf("connection desynced after oversized BDAT: NOOP got %q, want 250", reply)
+	}
+}
+
+// TestDataRejectedAfterBdatChunkingStarted confirms a client can't switch
+// from BDAT chunking to dot-terminated DATA mid-transaction -- RFC 3030 §3
+// treats the two as mutually exclusive, and silently accepting DATA would
+// discard whatever was already buffered via BDAT.
+func TestDataRejectedAfterBdatChunkingStarted(t *testing.T) {
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, nil, nil)
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readSMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("EHLO client.example.com")
+	readSMTPReply(t, client)
+	send("MAIL FROM:<a@example.com>")
+	readSMTPReply(t, client)
+	send("RCPT TO:<b@example.com>")
+	readSMTPReply(t, client)
+
+	send("BDAT 5")
+	clientConn.Write([]byte("hello"))
+	if reply := readSMTPReply(t, client); reply[:3] != "250" {
+		t.Fatalf("first BDAT chunk failed: %q", reply)
+	}
+
+	send("DATA")
+	if reply := readSMTPReply(t, client); reply[:3] != "503" {
+		t.Errorf("DATA after BDAT chunking started = %q, want 503", reply)
+	}
+}
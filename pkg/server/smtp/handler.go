@@ -3,6 +3,8 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +15,14 @@ import (
 
 	"github.com/jhillyerd/inbucket/pkg/log"
 	"github.com/jhillyerd/inbucket/pkg/policy"
+	"github.com/jhillyerd/inbucket/pkg/server/proto"
+)
+
+// Line length limits enforced by proto.ReadLimitedLine, per RFC 5321
+// §4.5.3.1.
+const (
+	maxCommandLineLength = 4000
+	maxDataLineLength    = 1000
 )
 
 // State tracks the current mode of our SMTP state machine
@@ -27,6 +37,10 @@ const (
 	MAIL
 	// DATA State: Got DATA, waiting for "."
 	DATA
+	// BDAT State: Received a non-LAST BDAT chunk, expecting more chunks
+	BDAT
+	// AUTH State: Got AUTH, exchanging SASL challenge/response lines
+	AUTH
 	// QUIT State: Client requested end of session
 	QUIT
 )
@@ -43,6 +57,10 @@ func (s State) String() string {
 		return "MAIL"
 	case DATA:
 		return "DATA"
+	case BDAT:
+		return "BDAT"
+	case AUTH:
+		return "AUTH"
 	case QUIT:
 		return "QUIT"
 	}
@@ -50,41 +68,54 @@ func (s State) String() string {
 }
 
 var commands = map[string]bool{
-	"HELO": true,
-	"EHLO": true,
-	"MAIL": true,
-	"RCPT": true,
-	"DATA": true,
-	"RSET": true,
-	"SEND": true,
-	"SOML": true,
-	"SAML": true,
-	"VRFY": true,
-	"EXPN": true,
-	"HELP": true,
-	"NOOP": true,
-	"QUIT": true,
-	"TURN": true,
+	"HELO":     true,
+	"EHLO":     true,
+	"MAIL":     true,
+	"RCPT":     true,
+	"DATA":     true,
+	"RSET":     true,
+	"SEND":     true,
+	"SOML":     true,
+	"SAML":     true,
+	"VRFY":     true,
+	"EXPN":     true,
+	"HELP":     true,
+	"NOOP":     true,
+	"QUIT":     true,
+	"TURN":     true,
+	"STARTTLS": true,
+	"AUTH":     true,
+	"BDAT":     true,
 }
 
 // Session holds the state of an SMTP session
 type Session struct {
-	server       *Server
-	id           int
-	conn         net.Conn
-	remoteDomain string
-	remoteHost   string
-	sendError    error
-	state        State
-	reader       *bufio.Reader
-	from         string
-	recipients   []*policy.Recipient
+	server        *Server
+	id            int
+	conn          net.Conn
+	remoteDomain  string
+	remoteHost    string
+	sendError     error
+	state         State
+	reader        *bufio.Reader
+	from          string
+	recipients    []*policy.Recipient
+	secure        bool
+	authUser      string
+	authMech      string
+	authStep      int
+	authUsername  string
+	chunkBuf      *bytes.Buffer
+	bytesReceived int
+	errBudget     proto.ErrorBudget
+	backend       BackendSession
 }
 
 // NewSession creates a new Session for the given connection
 func NewSession(server *Server, id int, conn net.Conn) *Session {
 	reader := bufio.NewReader(conn)
 	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	_, secure := conn.(*tls.Conn)
 	return &Session{
 		server:     server,
 		id:         id,
@@ -92,7 +123,9 @@ func NewSession(server *Server, id int, conn net.Conn) *Session {
 		state:      GREET,
 		reader:     reader,
 		remoteHost: host,
+		secure:     secure,
 		recipients: make([]*policy.Recipient, 0),
+		errBudget:  proto.ErrorBudget{Max: server.MaxErrors},
 	}
 }
 
@@ -119,6 +152,18 @@ func (s *Server) startSession(id int, conn net.Conn) {
 	}()
 
 	ss := NewSession(s, id, conn)
+	backend, err := s.Backend.NewSession(ss.remoteHost)
+	if err != nil {
+		ss.logWarn("Backend rejected new connection: %v", err)
+		ss.send(formatBackendErr(err, "554"))
+		return
+	}
+	if backend == nil {
+		ss.logError("Backend.NewSession returned a nil session with no error")
+		ss.send("421 Service not available")
+		return
+	}
+	ss.backend = backend
 	ss.greet()
 
 	// This is our command reading loop
@@ -128,6 +173,11 @@ func (s *Server) startSession(id int, conn net.Conn) {
 			ss.dataHandler()
 			continue
 		}
+		if ss.state == AUTH {
+			// Special case, SASL challenge/response lines aren't SMTP commands
+			ss.authHandler()
+			continue
+		}
 		line, err := ss.readLine()
 		if err == nil {
 			if cmd, arg, ok := ss.parseCmd(line); ok {
@@ -165,6 +215,9 @@ func (s *Server) startSession(id int, conn net.Conn) {
 					ss.send("221 Goodnight and good luck")
 					ss.enterState(QUIT)
 					continue
+				case "STARTTLS":
+					ss.starttlsHandler(arg)
+					continue
 				}
 
 				// Send command to handler for current state
@@ -178,6 +231,11 @@ func (s *Server) startSession(id int, conn net.Conn) {
 				case MAIL:
 					ss.mailHandler(cmd, arg)
 					continue
+				case BDAT:
+					// Further BDAT chunks are still dispatched through
+					// mailHandler, same as the first one.
+					ss.mailHandler(cmd, arg)
+					continue
 				}
 				ss.logError("Session entered unexpected state %v", ss.state)
 				break
@@ -196,6 +254,11 @@ func (s *Server) startSession(id int, conn net.Conn) {
 				}
 				break
 			}
+			if err == proto.ErrLineTooLong {
+				ss.send("500 Line too long")
+				ss.logWarn("Rejected command line exceeding %v bytes", maxCommandLineLength)
+				continue
+			}
 			// not an EOF
 			ss.logWarn("Connection error: %v", err)
 			if netErr, ok := err.(net.Error); ok {
@@ -211,6 +274,9 @@ func (s *Server) startSession(id int, conn net.Conn) {
 	if ss.sendError != nil {
 		ss.logWarn("Network send error: %v", ss.sendError)
 	}
+	if err := ss.backend.Logout(); err != nil {
+		ss.logWarn("Backend logout error: %v", err)
+	}
 	ss.logInfo("Closing connection")
 }
 
@@ -223,6 +289,10 @@ func (ss *Session) greetHandler(cmd string, arg string) {
 			ss.send("501 Domain/address argument required for HELO")
 			return
 		}
+		if err := ss.backend.Greet(domain); err != nil {
+			ss.send(formatBackendErr(err, "550"))
+			return
+		}
 		ss.remoteDomain = domain
 		ss.send("250 Great, let's get this show on the road")
 		ss.enterState(READY)
@@ -232,9 +302,23 @@ func (ss *Session) greetHandler(cmd string, arg string) {
 			ss.send("501 Domain/address argument required for EHLO")
 			return
 		}
+		if err := ss.backend.Greet(domain); err != nil {
+			ss.send(formatBackendErr(err, "550"))
+			return
+		}
 		ss.remoteDomain = domain
 		ss.send("250-Great, let's get this show on the road")
 		ss.send("250-8BITMIME")
+		if ss.server.TLSConfig != nil && !ss.secure {
+			ss.send("250-STARTTLS")
+		}
+		if ss.server.Authenticator != nil {
+			ss.send("250-AUTH PLAIN LOGIN")
+		}
+		ss.send("250-CHUNKING")
+		if ss.server.AllowBinaryMime {
+			ss.send("250-BINARYMIME")
+		}
 		ss.send(fmt.Sprintf("250 SIZE %v", ss.server.maxMessageBytes))
 		ss.enterState(READY)
 	default:
@@ -242,6 +326,201 @@ func (ss *Session) greetHandler(cmd string, arg string) {
 	}
 }
 
+// starttlsHandler negotiates STARTTLS (RFC 3207).  On success the
+// connection is wrapped in TLS and the session is reset to GREET, forcing
+// the client to re-issue HELO/EHLO on the encrypted channel.
+func (ss *Session) starttlsHandler(arg string) {
+	if ss.server.TLSConfig == nil {
+		ss.send("502 STARTTLS not supported")
+		return
+	}
+	if ss.secure {
+		ss.send("503 Already using TLS")
+		return
+	}
+	if arg != "" {
+		ss.send("501 Syntax error, STARTTLS takes no arguments")
+		return
+	}
+	ss.send("220 Ready to start TLS")
+	conn := tls.Server(ss.conn, ss.server.TLSConfig)
+	if err := conn.SetDeadline(ss.nextDeadline()); err != nil {
+		ss.logWarn("Failed to set TLS handshake deadline: %v", err)
+		ss.enterState(QUIT)
+		return
+	}
+	if err := conn.Handshake(); err != nil {
+		ss.logWarn("TLS handshake failed: %v", err)
+		ss.enterState(QUIT)
+		return
+	}
+	ss.conn = conn
+	ss.reader = bufio.NewReader(conn)
+	ss.secure = true
+	ss.remoteDomain = ""
+	// RFC 3207 §4.2: discard any knowledge obtained from the client prior to
+	// the TLS handshake, including an in-progress MAIL transaction and any
+	// AUTH performed in the clear -- the client must authenticate again
+	// over the encrypted channel.
+	ss.from = ""
+	ss.recipients = nil
+	ss.chunkBuf = nil
+	ss.bytesReceived = 0
+	ss.authUser = ""
+	ss.authMech = ""
+	ss.authStep = 0
+	ss.authUsername = ""
+	if err := ss.backend.Logout(); err != nil {
+		ss.logWarn("Backend logout error on pre-TLS session: %v", err)
+	}
+	// The pre-TLS session is already logged out above; swap in a no-op so
+	// the unconditional Logout() at the end of startSession doesn't invoke
+	// it a second time, regardless of how session creation below goes.
+	ss.backend = noopBackendSession{}
+	backend, err := ss.server.Backend.NewSession(ss.remoteHost)
+	if err != nil {
+		ss.logWarn("Backend rejected post-STARTTLS session: %v", err)
+		ss.enterState(QUIT)
+		return
+	}
+	if backend == nil {
+		ss.logError("Backend.NewSession returned a nil session with no error")
+		ss.enterState(QUIT)
+		return
+	}
+	ss.backend = backend
+	ss.enterState(GREET)
+	ss.logTrace("TLS handshake succeeded")
+}
+
+// authCmdHandler starts an AUTH PLAIN or AUTH LOGIN exchange (RFC 4954).
+func (ss *Session) authCmdHandler(arg string) {
+	if ss.server.Authenticator == nil {
+		ss.send("502 AUTH not supported")
+		return
+	}
+	if ss.authUser != "" {
+		ss.send("503 Already authenticated")
+		return
+	}
+	mech := arg
+	initial := ""
+	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
+		mech = arg[:idx]
+		initial = strings.TrimSpace(arg[idx+1:])
+	}
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		ss.authMech = "PLAIN"
+		if initial == "" {
+			ss.send("334 ")
+			ss.enterState(AUTH)
+			return
+		}
+		ss.finishAuthPlain(initial)
+	case "LOGIN":
+		ss.authMech = "LOGIN"
+		ss.authStep = 0
+		ss.send("334 VXNlcm5hbWU6")
+		ss.enterState(AUTH)
+	case "":
+		ss.send("501 Syntax error, AUTH requires a mechanism")
+	default:
+		ss.send("504 Unrecognized authentication mechanism")
+	}
+}
+
+// authHandler reads one challenge/response line while in the AUTH state.
+func (ss *Session) authHandler() {
+	line, err := ss.readLine()
+	if err != nil {
+		ss.logWarn("Connection error during AUTH: %v", err)
+		ss.enterState(QUIT)
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "*" {
+		ss.send("501 Authentication cancelled")
+		ss.resetAuth()
+		return
+	}
+	switch ss.authMech {
+	case "PLAIN":
+		ss.finishAuthPlain(line)
+	case "LOGIN":
+		ss.continueAuthLogin(line)
+	default:
+		ss.logError("AUTH state entered with unknown mechanism %q", ss.authMech)
+		ss.resetAuth()
+	}
+}
+
+// finishAuthPlain decodes an AUTH PLAIN response of the form
+// authzid\0authcid\0passwd and authenticates the session.
+func (ss *Session) finishAuthPlain(response string) {
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		ss.send("501 Invalid base64 encoding")
+		ss.resetAuth()
+		return
+	}
+	parts := bytes.SplitN(decoded, []byte{0}, 3)
+	if len(parts) != 3 {
+		ss.send("501 Invalid PLAIN response")
+		ss.resetAuth()
+		return
+	}
+	ss.completeAuth("PLAIN", string(parts[1]), string(parts[2]))
+}
+
+// continueAuthLogin advances an AUTH LOGIN exchange through its username
+// and password challenges.
+func (ss *Session) continueAuthLogin(response string) {
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		ss.send("501 Invalid base64 encoding")
+		ss.resetAuth()
+		return
+	}
+	switch ss.authStep {
+	case 0:
+		ss.authUsername = string(decoded)
+		ss.authStep = 1
+		ss.send("334 UGFzc3dvcmQ6")
+		ss.enterState(AUTH)
+	case 1:
+		ss.completeAuth("LOGIN", ss.authUsername, string(decoded))
+	}
+}
+
+// completeAuth invokes the configured Authenticator and records the
+// authenticated username on success.
+func (ss *Session) completeAuth(mechanism, username, password string) {
+	if err := ss.server.Authenticator(ss.remoteHost, mechanism, username, password); err != nil {
+		ss.send("535 Authentication failed")
+		ss.logWarn("AUTH %v failed for %q: %v", mechanism, username, err)
+		ss.resetAuth()
+		return
+	}
+	ss.authUser = username
+	ss.authUsername = ""
+	ss.send("235 Authentication successful")
+	ss.logInfo("Authenticated as %v via %v", username, mechanism)
+	ss.enterState(READY)
+}
+
+// resetAuth abandons an in-progress AUTH exchange and returns to READY,
+// unless trackError has already entered QUIT because the rejection used up
+// the error budget.
+func (ss *Session) resetAuth() {
+	ss.authMech = ""
+	ss.authStep = 0
+	ss.authUsername = ""
+	if ss.state != QUIT {
+		ss.enterState(READY)
+	}
+}
+
 func parseHelloArgument(arg string) (string, error) {
 	domain := arg
 	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
@@ -255,7 +534,21 @@ func parseHelloArgument(arg string) (string, error) {
 
 // READY state -> waiting for MAIL
 func (ss *Session) readyHandler(cmd string, arg string) {
+	if cmd == "AUTH" {
+		ss.authCmdHandler(arg)
+		return
+	}
 	if cmd == "MAIL" {
+		if ss.server.ForceTLS && !ss.secure {
+			ss.send("530 Must issue a STARTTLS command first")
+			ss.logWarn("Rejected MAIL, TLS required but not negotiated")
+			return
+		}
+		if ss.server.RequireAuth && ss.authUser == "" {
+			ss.send("530 Authentication required")
+			ss.logWarn("Rejected MAIL, authentication required but not completed")
+			return
+		}
 		// Match FROM, while accepting '>' as quoted pair and in double quoted strings
 		// (?i) makes the regex case insensitive, (?:) is non-grouping sub-match
 		re := regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])+|\"[^\"]+\"@[^>]+)>( [\\w= ]+)?$")
@@ -273,6 +566,7 @@ func (ss *Session) readyHandler(cmd string, arg string) {
 		}
 		// This is where the client may put BODY=8BITMIME, but we already
 		// read the DATA as bytes, so it does not effect our processing.
+		var sizeParam int
 		if m[2] != "" {
 			args, ok := ss.parseArgs(m[2])
 			if !ok {
@@ -292,8 +586,15 @@ func (ss *Session) readyHandler(cmd string, arg string) {
 					ss.logWarn("Client wanted to send oversized message: %v", args["SIZE"])
 					return
 				}
+				sizeParam = int(size)
 			}
 		}
+		opts := MailOptions{Size: sizeParam, AuthUser: ss.authUser}
+		if err := ss.backend.Mail(from, opts); err != nil {
+			ss.send(formatBackendErr(err, "550"))
+			ss.logWarn("Backend rejected MAIL from %q: %v", from, err)
+			return
+		}
 		ss.from = from
 		ss.logInfo("Mail from: %v", from)
 		ss.send(fmt.Sprintf("250 Roger, accepting mail from <%v>", from))
@@ -325,6 +626,11 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 			ss.send(fmt.Sprintf("552 Maximum limit of %v recipients reached", ss.server.maxRecips))
 			return
 		}
+		if err := ss.backend.Rcpt(addr); err != nil {
+			ss.send(formatBackendErr(err, "550"))
+			ss.logWarn("Backend rejected recipient %q: %v", addr, err)
+			return
+		}
 		ss.recipients = append(ss.recipients, recip)
 		ss.logInfo("Recipient: %v", addr)
 		ss.send(fmt.Sprintf("250 I'll make sure <%v> gets this", addr))
@@ -335,6 +641,13 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 			ss.logWarn("Got unexpected args on DATA: %q", arg)
 			return
 		}
+		if ss.chunkBuf != nil {
+			// RFC 3030 §3: BDAT and DATA are mutually exclusive within a
+			// transaction once chunking has started.
+			ss.send("503 DATA not allowed, message transfer already started with BDAT")
+			ss.logWarn("Rejected DATA after BDAT chunking had started")
+			return
+		}
 		if len(ss.recipients) > 0 {
 			// We have recipients, go to accept data
 			ss.enterState(DATA)
@@ -343,6 +656,13 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 		// DATA out of sequence
 		ss.ooSeq(cmd)
 		return
+	case "BDAT":
+		if len(ss.recipients) == 0 {
+			ss.ooSeq(cmd)
+			return
+		}
+		ss.bdatHandler(arg)
+		return
 	}
 	ss.ooSeq(cmd)
 }
@@ -354,6 +674,12 @@ func (ss *Session) dataHandler() {
 	for {
 		lineBuf, err := ss.readByteLine()
 		if err != nil {
+			if err == proto.ErrLineTooLong {
+				ss.send("500 Line too long")
+				ss.logWarn("DATA line exceeded %v bytes, aborting message", maxDataLineLength)
+				ss.reset()
+				return
+			}
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() {
 					ss.send("221 Idle timeout, bye bye")
@@ -365,24 +691,11 @@ func (ss *Session) dataHandler() {
 		}
 		if bytes.Equal(lineBuf, []byte(".\r\n")) || bytes.Equal(lineBuf, []byte(".\n")) {
 			// Mail data complete.
-			tstamp := time.Now().Format(timeStampFormat)
-			for _, recip := range ss.recipients {
-				if recip.ShouldStore() {
-					// Generate Received header.
-					prefix := fmt.Sprintf("Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
-						ss.remoteDomain, ss.remoteHost, ss.server.domain, recip.Address.Address,
-						tstamp)
-					// Deliver message.
-					_, err := ss.server.manager.Deliver(
-						recip, ss.from, ss.recipients, prefix, msgBuf.Bytes())
-					if err != nil {
-						ss.logError("delivery for %v: %v", recip.LocalPart, err)
-						ss.send(fmt.Sprintf("451 Failed to store message for %v", recip.LocalPart))
-						ss.reset()
-						return
-					}
-				}
-				expReceivedTotal.Add(1)
+			if err := ss.backend.Data(bytes.NewReader(msgBuf.Bytes())); err != nil {
+				ss.send(formatBackendErr(err, "451"))
+				ss.logWarn("Backend rejected message data: %v", err)
+				ss.reset()
+				return
 			}
 			ss.send("250 Mail accepted for delivery")
 			ss.logInfo("Message size %v bytes", msgBuf.Len())
@@ -403,6 +716,77 @@ func (ss *Session) dataHandler() {
 	}
 }
 
+// bdatHandler implements RFC 3030 CHUNKING.  Each BDAT command carries an
+// exact byte count to read verbatim (no dot-stuffing); the chunk marked
+// LAST triggers delivery via the same path as the dot-terminated DATA
+// command.
+func (ss *Session) bdatHandler(arg string) {
+	parts := strings.Fields(arg)
+	if len(parts) < 1 || len(parts) > 2 {
+		ss.send("501 Was expecting BDAT arg syntax of <size> [LAST]")
+		return
+	}
+	size, err := strconv.Atoi(parts[0])
+	if err != nil || size < 0 {
+		ss.send("501 Invalid chunk size")
+		return
+	}
+	last := false
+	if len(parts) == 2 {
+		if !strings.EqualFold(parts[1], "LAST") {
+			ss.send("501 Unknown BDAT parameter")
+			return
+		}
+		last = true
+	}
+	ss.bytesReceived += size
+	if ss.bytesReceived > ss.server.maxMessageBytes {
+		// Drain the chunk the client already sent so it isn't parsed as
+		// the next command line, same as the line-too-long path does.
+		if err := ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
+			ss.sendError = err
+			return
+		}
+		if _, err := io.CopyN(io.Discard, ss.reader, int64(size)); err != nil {
+			ss.logWarn("Error draining oversized BDAT chunk: %v", err)
+			ss.enterState(QUIT)
+			return
+		}
+		ss.send("552 Maximum message size exceeded")
+		ss.logWarn("Max message size exceeded during BDAT")
+		ss.reset()
+		return
+	}
+	if ss.chunkBuf == nil {
+		ss.chunkBuf = &bytes.Buffer{}
+	}
+	if size > 0 {
+		if err := ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
+			ss.sendError = err
+			return
+		}
+		if _, err := io.CopyN(ss.chunkBuf, ss.reader, int64(size)); err != nil {
+			ss.logWarn("Error reading BDAT chunk: %v", err)
+			ss.enterState(QUIT)
+			return
+		}
+	}
+	if !last {
+		ss.send(fmt.Sprintf("250 Message OK, %v octets received", size))
+		ss.enterState(BDAT)
+		return
+	}
+	if err := ss.backend.Data(bytes.NewReader(ss.chunkBuf.Bytes())); err != nil {
+		ss.send(formatBackendErr(err, "451"))
+		ss.logWarn("Backend rejected message data: %v", err)
+		ss.reset()
+		return
+	}
+	ss.send(fmt.Sprintf("250 Message OK, %v octets received", size))
+	ss.logInfo("Message size %v bytes (BDAT)", ss.bytesReceived)
+	ss.reset()
+}
+
 func (ss *Session) enterState(state State) {
 	ss.state = state
 	ss.logTrace("Entering state %v", state)
@@ -429,6 +813,20 @@ func (ss *Session) send(msg string) {
 		return
 	}
 	ss.logTrace(">> %v >>", msg)
+	if len(msg) >= 3 && msg[0] == '5' {
+		ss.trackError()
+	}
+}
+
+// trackError counts a 5xx response against Server.MaxErrors, closing the
+// connection once the budget is exceeded.  This keeps a misbehaving or
+// malicious client from pegging a goroutine by issuing endless garbage.
+func (ss *Session) trackError() {
+	if ss.errBudget.Track() {
+		ss.logWarn("Too many errors, closing connection")
+		ss.send("421 Too many errors")
+		ss.enterState(QUIT)
+	}
 }
 
 // readByteLine reads a line of input, returns byte slice.
@@ -436,7 +834,7 @@ func (ss *Session) readByteLine() ([]byte, error) {
 	if err := ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
 		return nil, err
 	}
-	return ss.reader.ReadBytes('\n')
+	return proto.ReadLimitedLine(ss.reader, maxDataLineLength)
 }
 
 // Reads a line of input
@@ -444,38 +842,34 @@ func (ss *Session) readLine() (line string, err error) {
 	if err = ss.conn.SetReadDeadline(ss.nextDeadline()); err != nil {
 		return "", err
 	}
-	line, err = ss.reader.ReadString('\n')
+	buf, err := proto.ReadLimitedLine(ss.reader, maxCommandLineLength)
 	if err != nil {
 		return "", err
 	}
+	line = string(buf)
 	ss.logTrace("<< %v <<", strings.TrimRight(line, "\r\n"))
 	return line, nil
 }
 
 func (ss *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 	line = strings.TrimRight(line, "\r\n")
-	l := len(line)
-	switch {
-	case l == 0:
+	if line == "" {
 		return "", "", true
-	case l < 4:
-		ss.logWarn("Command too short: %q", line)
-		return "", "", false
-	case l == 4:
-		return strings.ToUpper(line), "", true
-	case l == 5:
-		// Too long to be only command, too short to have args
-		ss.logWarn("Mangled command: %q", line)
-		return "", "", false
 	}
-	// If we made it here, command is long enough to have args
-	if line[4] != ' ' {
-		// There wasn't a space after the command?
-		ss.logWarn("Mangled command: %q", line)
+	// Commands aren't all 4 letters (STARTTLS is 8), so tokenize on the
+	// first space instead of assuming a fixed-width verb.
+	word := line
+	rest := ""
+	if idx := strings.IndexByte(line, ' '); idx >= 0 {
+		word = line[:idx]
+		rest = strings.Trim(line[idx+1:], " ")
+	}
+	if len(word) < 4 {
+		ss.logWarn("Command too short: %q", line)
 		return "", "", false
 	}
 	// I'm not sure if we should trim the args or not, but we will for now
-	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " "), true
+	return strings.ToUpper(word), rest, true
 }
 
 // parseArgs takes the arguments proceeding a command and files them
@@ -502,6 +896,11 @@ func (ss *Session) reset() {
 	ss.enterState(READY)
 	ss.from = ""
 	ss.recipients = nil
+	ss.chunkBuf = nil
+	ss.bytesReceived = 0
+	if ss.backend != nil {
+		ss.backend.Reset()
+	}
 }
 
 func (ss *Session) ooSeq(cmd string) {
@@ -0,0 +1,315 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/policy"
+)
+
+// recordingBackend is a test Backend/BackendSession that records the
+// MailOptions passed to Mail, so tests can assert AUTH identity threading
+// without needing a real storage-backed Manager.
+type recordingBackend struct {
+	mu       sync.Mutex
+	mailOpts []MailOptions
+}
+
+func (b *recordingBackend) NewSession(remoteHost string) (BackendSession, error) {
+	return b, nil
+}
+
+func (b *recordingBackend) Greet(domain string) error { return nil }
+
+func (b *recordingBackend) Mail(from string, opts MailOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mailOpts = append(b.mailOpts, opts)
+	return nil
+}
+
+func (b *recordingBackend) Rcpt(to string) error { return nil }
+
+func (b *recordingBackend) Data(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func (b *recordingBackend) Reset() {}
+
+func (b *recordingBackend) Logout() error { return nil }
+
+func (b *recordingBackend) lastMailOptions() (MailOptions, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.mailOpts) == 0 {
+		return MailOptions{}, false
+	}
+	return b.mailOpts[len(b.mailOpts)-1], true
+}
+
+// readSMTPReply reads a (possibly multi-line) SMTP reply and returns its
+// final line.
+func readSMTPReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var last string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading SMTP reply: %v", err)
+		}
+		last = line
+		if len(line) > 3 && line[3] == ' ' {
+			return last
+		}
+	}
+}
+
+// TestAuthIdentityThreadsToMail confirms the username established via AUTH
+// is threaded through to BackendSession.Mail via MailOptions.AuthUser, so
+// the Received header (and anything else a Backend cares about) can record
+// who actually submitted the message.
+func TestAuthIdentityThreadsToMail(t *testing.T) {
+	backend := &recordingBackend{}
+	server := NewServer("mail.example.com", 5, time.Second, 1<<20, nil, nil)
+	server.Backend = backend
+	server.Authenticator = func(remoteHost, mechanism, username, password string) error {
+		if username == "alice" && password == "wonderland" {
+			return nil
+		}
+		return errors.New("invalid credentials")
+	}
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readSMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("EHLO client.example.com")
+	readSMTPReply(t, client)
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wonderland"))
+	send("AUTH PLAIN " + creds)
+	if reply := readSMTPReply(t, client); reply[:3] != "235" {
+		t.Fatalf("AUTH PLAIN failed: %q", reply)
+	}
+
+	send("MAIL FROM:<bob@example.com>")
+	if reply := readSMTPReply(t, client); reply[:3] != "250" {
+		t.Fatalf("MAIL FROM failed: %q", reply)
+	}
+
+	opts, ok := backend.lastMailOptions()
+	if !ok {
+		t.Fatal("backend.Mail was never called")
+	}
+	if opts.AuthUser != "alice" {
+		t.Errorf("MailOptions.AuthUser = %q, want %q", opts.AuthUser, "alice")
+	}
+
+	send("QUIT")
+	readSMTPReply(t, client)
+}
+
+// generateSelfSignedCert builds an in-memory self-signed certificate for
+// use as a test Server's TLSConfig.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("building tls.Certificate: %v", err)
+	}
+	return cert
+}
+
+// TestStarttlsDiscardsTransactionState confirms STARTTLS discards
+// knowledge obtained from the client prior to the handshake (RFC 3207
+// §4.2), rather than only resetting remoteDomain.  A session that had
+// accepted a sender and recipients in cleartext must not let a
+// post-handshake DATA/BDAT deliver to them.
+func TestStarttlsDiscardsTransactionState(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, nil, nil)
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	ss := NewSession(server, 1, serverConn)
+	backend, err := server.Backend.NewSession(ss.remoteHost)
+	if err != nil {
+		t.Fatalf("backend.NewSession: %v", err)
+	}
+	ss.backend = backend
+
+	// Simulate a MAIL/RCPT transaction accepted before the TLS upgrade.
+	ss.from = "pretls@example.com"
+	ss.recipients = []*policy.Recipient{nil}
+	ss.enterState(MAIL)
+
+	done := make(chan struct{})
+	go func() {
+		ss.starttlsHandler("")
+		close(done)
+	}()
+
+	client := bufio.NewReader(clientConn)
+	reply, err := client.ReadString('\n')
+	if err != nil || len(reply) < 3 || reply[:3] != "220" {
+		t.Fatalf("expected 220 Ready to start TLS, got %q (err %v)", reply, err)
+	}
+	tlsClient := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake: %v", err)
+	}
+	defer tlsClient.Close()
+	<-done
+
+	if ss.from != "" {
+		t.Errorf("ss.from = %q, want empty after STARTTLS", ss.from)
+	}
+	if len(ss.recipients) != 0 {
+		t.Errorf("ss.recipients = %v, want empty after STARTTLS", ss.recipients)
+	}
+	if ss.state != GREET {
+		t.Errorf("ss.state = %v, want GREET after STARTTLS", ss.state)
+	}
+	if !ss.secure {
+		t.Error("ss.secure = false, want true after STARTTLS handshake")
+	}
+}
+
+// TestStarttlsReachableViaWireProtocol confirms parseCmd tokenizes on the
+// first space instead of assuming every command is 4 bytes wide, so a real
+// client can actually negotiate STARTTLS (8 letters) over the command loop.
+func TestStarttlsReachableViaWireProtocol(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, nil, nil)
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readSMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("EHLO client.example.com")
+	readSMTPReply(t, client)
+
+	send("STARTTLS")
+	if reply := readSMTPReply(t, client); reply[:3] != "220" {
+		t.Fatalf("STARTTLS reply = %q, want 220 Ready to start TLS", reply)
+	}
+}
+
+// TestAuthDoesNotSurviveSTARTTLS confirms a client that authenticates in
+// the clear and then negotiates STARTTLS must authenticate again on the
+// encrypted channel -- RFC 3207 §4.2 requires discarding any knowledge
+// obtained from the client prior to the handshake, including AUTH state.
+func TestAuthDoesNotSurviveSTARTTLS(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	server := NewServer("mail.example.com", 5, 5*time.Second, 1<<20, nil, nil)
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.RequireAuth = true
+	server.Authenticator = func(remoteHost, mechanism, username, password string) error {
+		if username == "alice" && password == "wonderland" {
+			return nil
+		}
+		return errors.New("invalid credentials")
+	}
+
+	serverConn, clientConn := net.Pipe()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+	defer clientConn.Close()
+
+	client := bufio.NewReader(clientConn)
+	readSMTPReply(t, client) // greeting
+
+	send := func(cmd string) {
+		if _, err := clientConn.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q: %v", cmd, err)
+		}
+	}
+
+	send("EHLO client.example.com")
+	readSMTPReply(t, client)
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wonderland"))
+	send("AUTH PLAIN " + creds)
+	if reply := readSMTPReply(t, client); reply[:3] != "235" {
+		t.Fatalf("AUTH PLAIN failed: %q", reply)
+	}
+
+	send("STARTTLS")
+	if reply := readSMTPReply(t, client); reply[:3] != "220" {
+		t.Fatalf("STARTTLS failed: %q", reply)
+	}
+	tlsClient := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake: %v", err)
+	}
+	defer tlsClient.Close()
+
+	tlsReader := bufio.NewReader(tlsClient)
+	sendTLS := func(cmd string) {
+		if _, err := tlsClient.Write([]byte(cmd + "\r\n")); err != nil {
+			t.Fatalf("writing %q over TLS: %v", cmd, err)
+		}
+	}
+
+	sendTLS("EHLO client.example.com")
+	readSMTPReply(t, tlsReader)
+
+	sendTLS("MAIL FROM:<bob@example.com>")
+	if reply := readSMTPReply(t, tlsReader); reply[:3] == "250" {
+		t.Errorf("MAIL succeeded post-STARTTLS without re-authenticating on the encrypted channel: %q", reply)
+	}
+}
@@ -0,0 +1,125 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/inbucket/pkg/log"
+	"github.com/jhillyerd/inbucket/pkg/policy"
+)
+
+// defaultMaxErrors is the default value of Server.MaxErrors.
+const defaultMaxErrors = 3
+
+// Manager delivers an accepted message to the configured storage backend.
+type Manager interface {
+	Deliver(recip *policy.Recipient, from string, recipients []*policy.Recipient, prefix string,
+		data []byte) (string, error)
+}
+
+// Server holds the configuration and state of an SMTP server instance.
+type Server struct {
+	domain          string
+	maxRecips       int
+	maxIdle         time.Duration
+	maxMessageBytes int
+	manager         Manager
+	apolicy         *policy.Addressing
+
+	listener  net.Listener
+	waitgroup *sync.WaitGroup
+
+	// TLSConfig, when set, enables the STARTTLS extension (RFC 3207) and,
+	// combined with ImplicitTLS, implicit TLS listeners.
+	TLSConfig *tls.Config
+	// ForceTLS rejects MAIL commands until the client has negotiated TLS,
+	// either via STARTTLS or an implicit TLS listener.
+	ForceTLS bool
+	// ImplicitTLS wraps every accepted connection in TLS before the SMTP
+	// session starts, for listeners bound to a submissions-style port
+	// (e.g. 465) where the client expects TLS from the first byte.
+	ImplicitTLS bool
+
+	// Authenticator, when set, enables the AUTH extension (RFC 4954) and
+	// is called to verify AUTH PLAIN/LOGIN credentials.
+	Authenticator func(remoteHost, mechanism, username, password string) error
+	// RequireAuth rejects MAIL commands until the client has successfully
+	// authenticated.
+	RequireAuth bool
+
+	// AllowBinaryMime advertises BINARYMIME (RFC 3030) alongside CHUNKING,
+	// letting senders transmit 8-bit binary payloads via BDAT.
+	AllowBinaryMime bool
+
+	// MaxErrors is the number of 5xx responses tolerated on a connection
+	// before it is dropped with "421 Too many errors".  Zero disables the
+	// limit. Defaults to defaultMaxErrors.
+	MaxErrors int
+
+	// Backend customizes transaction handling -- see the Backend and
+	// BackendSession interfaces. Defaults to a storage-backed
+	// implementation preserving Inbucket's original behavior.
+	Backend Backend
+}
+
+// NewServer creates a new, unstarted Server.
+func NewServer(domain string, maxRecips int, maxIdle time.Duration, maxMessageBytes int,
+	manager Manager, apolicy *policy.Addressing) *Server {
+	s := &Server{
+		domain:          domain,
+		maxRecips:       maxRecips,
+		maxIdle:         maxIdle,
+		maxMessageBytes: maxMessageBytes,
+		manager:         manager,
+		apolicy:         apolicy,
+		waitgroup:       new(sync.WaitGroup),
+		MaxErrors:       defaultMaxErrors,
+	}
+	s.Backend = &defaultBackend{domain: domain, manager: manager, apolicy: apolicy}
+	return s
+}
+
+// Start accepts connections on addr until Stop is called.
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", addr, err)
+	}
+	if s.ImplicitTLS {
+		if s.TLSConfig == nil {
+			return fmt.Errorf("ImplicitTLS requires a TLSConfig")
+		}
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	s.listener = listener
+	log.Infof("SMTP listening on TCP %v", addr)
+
+	var id int
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("Temporary error accepting SMTP connection: %v", err)
+				continue
+			}
+			// Listener closed, shutting down.
+			return nil
+		}
+		s.waitgroup.Add(1)
+		id++
+		go s.startSession(id, conn)
+	}
+}
+
+// Stop closes the listening socket, allowing in-flight sessions to finish.
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.waitgroup.Wait()
+	return err
+}